@@ -0,0 +1,694 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/cossacklabs/themis/gothemis/cell"
+	"golang.org/x/term"
+)
+
+// streamMagic identifies a framed Secure Cell stream produced by -in/-out
+// mode, so that decrypt can reject arbitrary non-stream input up front. The
+// version number is bumped whenever the frame layout changes.
+const streamMagic = "THMS2"
+
+// streamChunkSize is the amount of plaintext encrypted into each frame. Keeping
+// it fixed and well below typical memory limits lets -in/-out mode process
+// files much larger than RAM.
+const streamChunkSize = 1 << 20 // 1 MiB
+
+// modes maps the -mode flag values accepted on the command line to the
+// corresponding Secure Cell mode constant.
+var modes = map[string]cell.SecureCellMode{
+	"seal":            cell.ModeSeal,
+	"token":           cell.ModeTokenProtect,
+	"context_imprint": cell.ModeContextImprint,
+}
+
+// keySize is the length in bytes of the symmetric keys keygen produces.
+const keySize = 32
+
+func usage() {
+	fmt.Printf("usage: %s <command> [-password <pw> | -password-file <path> | -password-env <VAR> | -key-file <path> | -key-hex <hex>] [-mode ...] <message>\n", os.Args[0])
+	fmt.Printf("       %s <command> [-password ... | -key-file ... | -key-hex ...] [-mode ...] -in <path> -out <path>\n", os.Args[0])
+	fmt.Printf("       %s keygen -out <path>\n", os.Args[0])
+	fmt.Println("if none of -password, -password-file, -password-env, -key-file or -key-hex is")
+	fmt.Println("given, the password is read from the controlling terminal (with confirmation on")
+	fmt.Println("enc), or from stdin if stdin is not a terminal; -binary dec has no such fallback")
+	fmt.Println("and needs one of these flags, since it reads the ciphertext from stdin")
+	fmt.Println("commands:")
+	fmt.Println("  enc    encrypt the message and print base64 ciphertext, or encrypt the -in file")
+	fmt.Println("         into a binary framed stream written to -out")
+	fmt.Println("  dec    decrypt the message (or -in file) and print/write the plaintext")
+	fmt.Println("  keygen generate a random symmetric key, write it to -out, and print its")
+	fmt.Println("         fingerprint; use the result with -key-file")
+	fmt.Println("modes:")
+	fmt.Println("  seal             (default) authenticated encryption, safe with no extra context")
+	fmt.Println("  token            authenticated encryption with a detached auth token; encrypt")
+	fmt.Println("                   packs the ciphertext and auth token into a single base64 blob;")
+	fmt.Println("                   decrypt expects the same")
+	fmt.Println("  context_imprint  same-length output, no authentication tag; requires -context or")
+	fmt.Println("                   -context-file and is only safe when the context is unique and")
+	fmt.Println("                   the plaintext has its own integrity/format checks")
+	fmt.Println("-context/-context-file bind a ciphertext to an application-defined scope (user ID,")
+	fmt.Println("filename, record key, ...); in seal and token modes a blob encrypted under one")
+	fmt.Println("context won't decrypt under another (context_imprint yields wrong bytes instead)")
+	fmt.Println("-encoding selects the base64 alphabet (std, stdraw, url, urlraw, custom:<64 chars>)")
+	fmt.Println("-binary skips base64 entirely: enc writes raw bytes to stdout, dec reads raw")
+	fmt.Println("ciphertext bytes from stdin")
+	fmt.Println("-key-file/-key-hex use a real symmetric key instead of a passphrase, skipping the")
+	fmt.Println("password entirely; mutually exclusive with -password/-password-file/-password-env")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		return
+	}
+	command := os.Args[1]
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	modeName := fs.String("mode", "seal", "Secure Cell mode: seal, token, or context_imprint")
+	contextArg := fs.String("context", "", "context to bind the message to (required for -mode context_imprint); mutually exclusive with -context-file")
+	contextFile := fs.String("context-file", "", "read the context from this file instead of -context")
+	inPath := fs.String("in", "", "read the message from this file instead of argv, streaming it in chunks (for large files)")
+	outPath := fs.String("out", "", "write the streamed result to this file (only together with -in), or the key for keygen")
+	passwordArg := fs.String("password", "", "password to derive the Secure Cell key from (prompted interactively if omitted)")
+	passwordFile := fs.String("password-file", "", "read the password from this file instead of -password")
+	passwordEnv := fs.String("password-env", "", "read the password from this environment variable instead of -password")
+	keyFile := fs.String("key-file", "", "use the raw symmetric key in this file instead of a passphrase (see keygen)")
+	keyHex := fs.String("key-hex", "", "use this hex-encoded raw symmetric key instead of a passphrase")
+	encodingName := fs.String("encoding", "std", "base64 alphabet for ciphertext: std, stdraw, url, urlraw, or custom:<64-char-alphabet>")
+	binaryFlag := fs.Bool("binary", false, "skip base64 entirely; enc writes raw bytes to stdout, dec reads raw ciphertext bytes from stdin")
+	fs.Parse(os.Args[2:])
+
+	if "keygen" == command {
+		if err := runKeygen(*outPath); nil != err {
+			fmt.Println("error generating key:", err)
+		}
+		return
+	}
+
+	mode, ok := modes[*modeName]
+	if !ok {
+		fmt.Printf("unknown -mode %q (want seal, token, or context_imprint)\n", *modeName)
+		return
+	}
+
+	encoding, err := resolveEncoding(*encodingName)
+	if nil != err {
+		fmt.Println("error parsing -encoding:", err)
+		return
+	}
+
+	context, err := resolveContext(*contextArg, *contextFile)
+	if nil != err {
+		fmt.Println("error reading context:", err)
+		return
+	}
+	if cell.ModeContextImprint == mode && 0 == len(context) {
+		fmt.Println("-mode context_imprint requires -context or -context-file (it provides no integrity on its own)")
+		return
+	}
+
+	// -binary dec reads its ciphertext from stdin instead of argv, since raw
+	// bytes can't reliably round-trip through a shell argument. This must be
+	// known before resolving the key, since the password fallback also reads
+	// from stdin and would otherwise consume the piped ciphertext.
+	readsStdin := *binaryFlag && "dec" == command
+
+	key, err := resolveKey(command, *passwordArg, *passwordFile, *passwordEnv, *keyFile, *keyHex, readsStdin)
+	if nil != err {
+		fmt.Println("error reading key:", err)
+		return
+	}
+
+	sc := cell.New(key, mode)
+
+	if "" != *inPath || "" != *outPath {
+		if "" == *inPath || "" == *outPath {
+			fmt.Println("both -in and -out are required for streaming mode")
+			return
+		}
+		if err := runStream(sc, command, *inPath, *outPath, context); nil != err {
+			fmt.Println(err)
+		}
+		return
+	}
+
+	if !readsStdin && 1 != fs.NArg() {
+		usage()
+		return
+	}
+	if readsStdin && 0 != fs.NArg() {
+		fmt.Println("-binary dec reads ciphertext from stdin; it does not take a <message> argument")
+		return
+	}
+
+	switch command {
+	case "enc":
+		message := []byte(fs.Arg(0))
+		if *binaryFlag {
+			raw, err := encryptMessageBinary(sc, mode, message, context)
+			if nil != err {
+				fmt.Println("error encrypting message:", err)
+				return
+			}
+			os.Stdout.Write(raw)
+			return
+		}
+		out, err := encryptMessage(sc, mode, message, context, encoding)
+		if nil != err {
+			fmt.Println("error encrypting message:", err)
+			return
+		}
+		fmt.Println(out)
+	case "dec":
+		if *binaryFlag {
+			raw, err := io.ReadAll(os.Stdin)
+			if nil != err {
+				fmt.Println("error reading ciphertext from stdin:", err)
+				return
+			}
+			decData, err := decryptMessageBinary(sc, mode, raw, context)
+			if nil != err {
+				fmt.Println("error decrypting message:", err)
+				return
+			}
+			os.Stdout.Write(decData)
+			return
+		}
+		decData, err := decryptMessage(sc, mode, fs.Arg(0), context, encoding)
+		if nil != err {
+			fmt.Println("error decrypting message:", err)
+			return
+		}
+		fmt.Println(string(decData))
+	default:
+		usage()
+	}
+}
+
+// runKeygen generates a random keySize-byte symmetric key, writes it to
+// outPath with owner-only permissions, and prints its fingerprint to
+// stderr so the operator can confirm which key a later -key-file refers
+// to without ever printing the key itself.
+func runKeygen(outPath string) error {
+	if "" == outPath {
+		return errors.New("keygen requires -out <path>")
+	}
+
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); nil != err {
+		return fmt.Errorf("generating key: %w", err)
+	}
+	// WriteFile's permission only applies when it creates the file, so an
+	// existing file is tightened to owner-only before the key goes into it.
+	if err := os.Chmod(outPath, 0600); nil != err && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("setting key file permissions: %w", err)
+	}
+	if err := os.WriteFile(outPath, key, 0600); nil != err {
+		return fmt.Errorf("writing key file: %w", err)
+	}
+
+	fingerprint := sha256.Sum256(key)
+	fmt.Fprintf(os.Stderr, "key written to %s, fingerprint %x\n", outPath, fingerprint[:8])
+	return nil
+}
+
+// resolveKey determines the raw key bytes to pass to cell.New: either a
+// real symmetric key read from -key-file/-key-hex, or a password (see
+// resolvePassword) used directly as key material, as gothemis' Secure
+// Cell does not perform a separate KDF step over the password. readsStdin
+// must be true when the caller is also about to read raw ciphertext from
+// stdin (-binary dec): the password fallback reads from the same stdin,
+// so in that case an explicit -password*/-key-* source is required rather
+// than silently consuming the piped ciphertext as a password line.
+func resolveKey(command, passwordArg, passwordFile, passwordEnv, keyFile, keyHex string, readsStdin bool) ([]byte, error) {
+	passwordSet := "" != passwordArg || "" != passwordFile || "" != passwordEnv
+	keySet := "" != keyFile || "" != keyHex
+	if passwordSet && keySet {
+		return nil, errors.New("specify either a password (-password/-password-file/-password-env) or a key (-key-file/-key-hex), not both")
+	}
+	if "" != keyFile && "" != keyHex {
+		return nil, errors.New("specify at most one of -key-file, -key-hex")
+	}
+
+	switch {
+	case "" != keyFile:
+		return os.ReadFile(keyFile)
+	case "" != keyHex:
+		return hex.DecodeString(keyHex)
+	}
+
+	if readsStdin && !passwordSet {
+		return nil, errors.New("-binary dec reads ciphertext from stdin; specify -password, -password-file, -password-env, -key-file, or -key-hex explicitly instead of the stdin/terminal password fallback")
+	}
+
+	password, err := resolvePassword(command, passwordArg, passwordFile, passwordEnv)
+	if nil != err {
+		return nil, err
+	}
+	return []byte(password), nil
+}
+
+// resolvePassword determines the password to derive the Secure Cell key
+// from, in order: an explicit flag, a file, an environment variable, or
+// (if none of those are given) the controlling terminal with confirmation
+// on encrypt, falling back to a single line of stdin when stdin isn't a
+// terminal. There is no positional <password> argument; only -password
+// takes the password from argv, where it shows up in shell history and the
+// process list, while the other sources keep it out of argv.
+func resolvePassword(command, passwordArg, passwordFile, passwordEnv string) (string, error) {
+	sources := 0
+	for _, set := range []bool{"" != passwordArg, "" != passwordFile, "" != passwordEnv} {
+		if set {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return "", errors.New("specify at most one of -password, -password-file, -password-env")
+	}
+
+	switch {
+	case "" != passwordArg:
+		return passwordArg, nil
+	case "" != passwordFile:
+		data, err := os.ReadFile(passwordFile)
+		if nil != err {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case "" != passwordEnv:
+		password, ok := os.LookupEnv(passwordEnv)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", passwordEnv)
+		}
+		return password, nil
+	}
+
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		return promptPassword(command)
+	}
+	return readPasswordLine(os.Stdin)
+}
+
+// promptPassword reads a password from the controlling terminal without
+// echoing it, asking for confirmation on enc so a typo doesn't lock the
+// user out of data they just encrypted.
+func promptPassword(command string) (string, error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if nil != err {
+		return "", err
+	}
+
+	if "enc" == command {
+		fmt.Fprint(os.Stderr, "Confirm password: ")
+		confirmation, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if nil != err {
+			return "", err
+		}
+		if string(password) != string(confirmation) {
+			return "", errors.New("passwords did not match")
+		}
+	}
+	return string(password), nil
+}
+
+// readPasswordLine reads a single line from a non-terminal stdin, so the
+// password can be piped in (e.g. from a secrets manager or another tool).
+func readPasswordLine(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if nil != err && io.EOF != err {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// resolveContext reads the Secure Cell context bytes from -context or
+// -context-file; at most one of the two may be given.
+func resolveContext(contextArg, contextFile string) ([]byte, error) {
+	if "" != contextArg && "" != contextFile {
+		return nil, errors.New("specify at most one of -context, -context-file")
+	}
+	if "" != contextFile {
+		return os.ReadFile(contextFile)
+	}
+	return []byte(contextArg), nil
+}
+
+// resolveEncoding parses the -encoding flag value into the base64 alphabet
+// it selects.
+func resolveEncoding(name string) (*base64.Encoding, error) {
+	switch {
+	case "std" == name:
+		return base64.StdEncoding, nil
+	case "stdraw" == name:
+		return base64.RawStdEncoding, nil
+	case "url" == name:
+		return base64.URLEncoding, nil
+	case "urlraw" == name:
+		return base64.RawURLEncoding, nil
+	case strings.HasPrefix(name, "custom:"):
+		alphabet := strings.TrimPrefix(name, "custom:")
+		if 64 != len(alphabet) {
+			return nil, fmt.Errorf("custom alphabet must be exactly 64 characters, got %d", len(alphabet))
+		}
+		if err := validateAlphabet(alphabet); nil != err {
+			return nil, fmt.Errorf("custom alphabet: %w", err)
+		}
+		return base64.NewEncoding(alphabet), nil
+	default:
+		return nil, fmt.Errorf("unknown -encoding %q (want std, stdraw, url, urlraw, or custom:<64-char-alphabet>)", name)
+	}
+}
+
+// defaultPadChar is the padding character base64.NewEncoding assigns to an
+// encoding built from a raw alphabet string (WithPadding is not called).
+const defaultPadChar = '='
+
+// validateAlphabet rejects custom base64 alphabets that base64.NewEncoding
+// would otherwise accept but that break at runtime: "\r"/"\n" make it
+// panic; duplicate characters, or a character that collides with the
+// padding character, produce an ambiguous decode map that silently
+// corrupts output instead of raising a clear error.
+func validateAlphabet(alphabet string) error {
+	seen := make(map[byte]bool, len(alphabet))
+	for i := 0; i < len(alphabet); i++ {
+		c := alphabet[i]
+		if '\r' == c || '\n' == c {
+			return errors.New("must not contain carriage return or newline characters")
+		}
+		if defaultPadChar == c {
+			return fmt.Errorf("must not contain the padding character %q", c)
+		}
+		if seen[c] {
+			return fmt.Errorf("must not contain duplicate characters (got %q more than once)", c)
+		}
+		seen[c] = true
+	}
+	return nil
+}
+
+// packToken concatenates a Token Protect token and ciphertext into a single
+// length-prefixed blob, so callers don't need a delimiter character that a
+// user-chosen -encoding alphabet might legally contain (a literal ":" was
+// tried first and broke exactly that way).
+func packToken(token, encData []byte) []byte {
+	out := make([]byte, 4+len(token)+len(encData))
+	binary.BigEndian.PutUint32(out[:4], uint32(len(token)))
+	copy(out[4:], token)
+	copy(out[4+len(token):], encData)
+	return out
+}
+
+// unpackToken reverses packToken.
+func unpackToken(raw []byte) (token, encData []byte, err error) {
+	if len(raw) < 4 {
+		return nil, nil, errors.New("truncated input: missing token length")
+	}
+	tokenLen := binary.BigEndian.Uint32(raw[:4])
+	if uint32(len(raw)-4) < tokenLen {
+		return nil, nil, errors.New("truncated input: token shorter than declared length")
+	}
+	return raw[4 : 4+tokenLen], raw[4+tokenLen:], nil
+}
+
+// encryptMessage Protects message under the given mode and renders the
+// result as base64 text (in the given alphabet) the CLI prints or feeds
+// back into decrypt. Token Protect mode has a detached auth token, so its
+// result is the single base64 blob produced by packToken.
+func encryptMessage(sc *cell.SecureCell, mode cell.SecureCellMode, message, context []byte, encoding *base64.Encoding) (string, error) {
+	encData, token, err := sc.Protect(message, context)
+	if nil != err {
+		return "", err
+	}
+	if cell.ModeTokenProtect == mode {
+		return encoding.EncodeToString(packToken(token, encData)), nil
+	}
+	return encoding.EncodeToString(encData), nil
+}
+
+// decryptMessage reverses encryptMessage for the given mode.
+func decryptMessage(sc *cell.SecureCell, mode cell.SecureCellMode, message string, context []byte, encoding *base64.Encoding) ([]byte, error) {
+	if cell.ModeTokenProtect == mode {
+		raw, err := encoding.DecodeString(message)
+		if nil != err {
+			return nil, fmt.Errorf("decoding message: %w", err)
+		}
+		token, encData, err := unpackToken(raw)
+		if nil != err {
+			return nil, err
+		}
+		return sc.Unprotect(encData, context, token)
+	}
+
+	decodedMessage, err := encoding.DecodeString(message)
+	if nil != err {
+		return nil, fmt.Errorf("decoding message: %w", err)
+	}
+	return sc.Unprotect(decodedMessage, context, nil)
+}
+
+// encryptMessageBinary is the -binary counterpart to encryptMessage: it
+// skips base64 and returns the raw bytes to write to stdout.
+func encryptMessageBinary(sc *cell.SecureCell, mode cell.SecureCellMode, message, context []byte) ([]byte, error) {
+	encData, token, err := sc.Protect(message, context)
+	if nil != err {
+		return nil, err
+	}
+	if cell.ModeTokenProtect != mode {
+		return encData, nil
+	}
+	return packToken(token, encData), nil
+}
+
+// decryptMessageBinary reverses encryptMessageBinary for the given mode.
+func decryptMessageBinary(sc *cell.SecureCell, mode cell.SecureCellMode, raw, context []byte) ([]byte, error) {
+	if cell.ModeTokenProtect != mode {
+		return sc.Unprotect(raw, context, nil)
+	}
+	token, encData, err := unpackToken(raw)
+	if nil != err {
+		return nil, err
+	}
+	return sc.Unprotect(encData, context, token)
+}
+
+// runStream encrypts or decrypts inPath into outPath using the framed
+// chunked format, so neither file needs to fit in memory. context, if
+// non-empty, is mixed into every chunk's context alongside its index.
+func runStream(sc *cell.SecureCell, command, inPath, outPath string, context []byte) error {
+	in, err := os.Open(inPath)
+	if nil != err {
+		return fmt.Errorf("opening input file: %w", err)
+	}
+	defer in.Close()
+
+	out, err := os.Create(outPath)
+	if nil != err {
+		return fmt.Errorf("creating output file: %w", err)
+	}
+	defer out.Close()
+
+	bufOut := bufio.NewWriter(out)
+
+	switch command {
+	case "enc":
+		err = encryptStream(sc, in, bufOut, context)
+	case "dec":
+		err = decryptStream(sc, in, bufOut, context)
+	default:
+		return fmt.Errorf("unknown command %q", command)
+	}
+	if nil != err {
+		return err
+	}
+	return bufOut.Flush()
+}
+
+// chunkContext builds the Secure Cell context for a chunk: the caller's
+// context (if any) followed by an 8-byte big-endian chunk index and a
+// final-chunk flag byte. In seal and token modes Secure Cell authenticates
+// the context, so a chunk replayed at a different index, under a different
+// caller context, or with a flipped final flag fails to decrypt, which is
+// what catches reordering, dropping and truncation of chunks. Context
+// Imprint mode has no authentication: there such a chunk decrypts to wrong
+// bytes instead of failing.
+func chunkContext(context []byte, index uint64, final bool) []byte {
+	ctx := make([]byte, len(context)+9)
+	n := copy(ctx, context)
+	binary.BigEndian.PutUint64(ctx[n:], index)
+	if final {
+		ctx[n+8] = 1
+	}
+	return ctx
+}
+
+// encryptStream writes the stream header followed by one encrypted frame per
+// streamChunkSize bytes of plaintext read from r.
+func encryptStream(sc *cell.SecureCell, r io.Reader, w io.Writer, context []byte) error {
+	if _, err := w.Write([]byte(streamMagic)); nil != err {
+		return err
+	}
+
+	br := bufio.NewReaderSize(r, streamChunkSize)
+	buf := make([]byte, streamChunkSize)
+	var index uint64
+
+	for {
+		n, readErr := io.ReadFull(br, buf)
+		if nil != readErr && io.ErrUnexpectedEOF != readErr && io.EOF != readErr {
+			return fmt.Errorf("reading input: %w", readErr)
+		}
+
+		_, peekErr := br.Peek(1)
+		final := nil != peekErr
+
+		if 0 == n && !final {
+			continue
+		}
+		if 0 == n && final && index > 0 {
+			// Nothing left to encrypt after earlier chunks. The Peek above
+			// already marks the last non-empty chunk final (also when the
+			// input size is an exact multiple of streamChunkSize) and the
+			// loop then stops, so a bufio.Reader never gets here.
+			break
+		}
+
+		ciphertext, token, err := sc.Protect(buf[:n], chunkContext(context, index, final))
+		if nil != err {
+			return fmt.Errorf("encrypting chunk %d: %w", index, err)
+		}
+		if err := writeFrame(w, final, ciphertext, token); nil != err {
+			return err
+		}
+
+		index++
+		if final {
+			break
+		}
+	}
+	return nil
+}
+
+// decryptStream reads frames written by encryptStream, verifying that the
+// stream is intact and ends on a frame marked final.
+func decryptStream(sc *cell.SecureCell, r io.Reader, w io.Writer, context []byte) error {
+	magic := make([]byte, len(streamMagic))
+	if _, err := io.ReadFull(r, magic); nil != err {
+		return fmt.Errorf("reading stream header: %w", err)
+	}
+	if streamMagic != string(magic) {
+		return errors.New("not a themis stream file (bad magic header)")
+	}
+
+	var index uint64
+	sawFinal := false
+
+	for {
+		final, ciphertext, token, err := readFrame(r)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if nil != err {
+			return fmt.Errorf("reading chunk %d: %w", index, err)
+		}
+		if sawFinal {
+			return fmt.Errorf("chunk %d found after the stream's final chunk", index)
+		}
+
+		plaintext, err := sc.Unprotect(ciphertext, chunkContext(context, index, final), token)
+		if nil != err {
+			return fmt.Errorf("decrypting chunk %d: %w", index, err)
+		}
+		if _, err := w.Write(plaintext); nil != err {
+			return err
+		}
+
+		sawFinal = final
+		index++
+	}
+
+	if !sawFinal {
+		return errors.New("truncated stream: no final chunk marker seen")
+	}
+	return nil
+}
+
+// writeFrame appends one [final flag][ciphertext length][ciphertext][token
+// length][token] frame to w. token is only non-empty in Token Protect mode.
+func writeFrame(w io.Writer, final bool, ciphertext, token []byte) error {
+	var header [5]byte
+	if final {
+		header[0] = 1
+	}
+	binary.BigEndian.PutUint32(header[1:], uint32(len(ciphertext)))
+	if _, err := w.Write(header[:]); nil != err {
+		return err
+	}
+	if _, err := w.Write(ciphertext); nil != err {
+		return err
+	}
+
+	var tokenLen [4]byte
+	binary.BigEndian.PutUint32(tokenLen[:], uint32(len(token)))
+	if _, err := w.Write(tokenLen[:]); nil != err {
+		return err
+	}
+	_, err := w.Write(token)
+	return err
+}
+
+// readFrame reads one frame written by writeFrame, returning io.EOF only
+// when the stream ends cleanly between frames.
+func readFrame(r io.Reader) (final bool, ciphertext, token []byte, err error) {
+	var header [5]byte
+	if _, err = io.ReadFull(r, header[:]); nil != err {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			err = fmt.Errorf("truncated frame header: %w", err)
+		}
+		return false, nil, nil, err
+	}
+
+	// Once the header is read, running out of input is a truncated frame,
+	// not a clean end of stream, so io.EOF is reported as ErrUnexpectedEOF.
+	truncated := func(what string, err error) error {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("truncated %s: %w", what, err)
+	}
+
+	final = 1 == header[0]
+	ctLen := binary.BigEndian.Uint32(header[1:])
+	ciphertext = make([]byte, ctLen)
+	if _, err = io.ReadFull(r, ciphertext); nil != err {
+		return false, nil, nil, truncated("frame body", err)
+	}
+
+	var tokenLenBuf [4]byte
+	if _, err = io.ReadFull(r, tokenLenBuf[:]); nil != err {
+		return false, nil, nil, truncated("token length", err)
+	}
+	tokenLen := binary.BigEndian.Uint32(tokenLenBuf[:])
+	token = make([]byte, tokenLen)
+	if _, err = io.ReadFull(r, token); nil != err {
+		return false, nil, nil, truncated("token", err)
+	}
+	return final, ciphertext, token, nil
+}